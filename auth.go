@@ -0,0 +1,202 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAuthCancelled is returned by Conn.Challenge, and by DoAuth,
+// when the client cancels an authentication exchange by
+// responding to a challenge with a lone "*", as specified for
+// the AUTH command family.
+var ErrAuthCancelled = errors.New("smtplike: authentication cancelled by client")
+
+/*
+Auth is implemented by a SASL mechanism driving an AUTH command,
+modeled on the Auth interface in net/smtp but playing the
+server's side of the exchange.
+
+Start is called once a client has selected the mechanism.  It
+returns the mechanism's name (for the Handler's own bookkeeping;
+DoAuth doesn't use it) and a challenge to send to the client, or
+nil if the mechanism is already done and needs no challenge at
+all.
+
+Next is called with the client's decoded response to the last
+challenge, and more true for as long as the previous call
+returned a non-nil challenge.  It returns the next challenge to
+send, or nil once the mechanism has everything it needs; a nil
+challenge and nil error end the exchange, after which whatever
+the mechanism captured (a Username and Password, say) is there
+for the Handler to verify and, if good, store in Conn.Ctx.
+*/
+type Auth interface {
+	Start(c *Conn) (mech string, challenge []byte, err error)
+	Next(fromClient []byte, more bool) (challenge []byte, err error)
+}
+
+/*
+Challenge sends a 334 reply with prompt base64-encoded as the
+challenge text, then reads one line of response from the client
+and base64-decodes it, subject to the same MaxLineLength and
+ReadTimeout as any other line (see RunWithOptions).  A lone "*"
+cancels the exchange per the AUTH command family's convention;
+Challenge reports that by returning ErrAuthCancelled.
+*/
+func (c *Conn) Challenge(prompt []byte) ([]byte, error) {
+	if c.err = c.respond(334, base64.StdEncoding.EncodeToString(prompt)); c.err != nil {
+		return nil, c.err
+	}
+	if c.err = c.setReadDeadline(c.readTimeout); c.err != nil {
+		return nil, c.err
+	}
+	line, err := readLine(c.in, c.maxLineLength)
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	if chop(line) == "*" {
+		c.err = ErrAuthCancelled
+		return nil, ErrAuthCancelled
+	}
+	data, err := base64.StdEncoding.DecodeString(chop(line))
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+DoAuth drives a complete exchange for the mechanism a over c: it
+calls a.Start, sends any challenge it gets back with
+Conn.Challenge, and keeps feeding the decoded responses to
+a.Next for as long as Next keeps asking for another round.  It
+returns once the mechanism is done or an error, including
+ErrAuthCancelled, ends the exchange early; verifying whatever a
+captured is left to the caller.
+*/
+func (c *Conn) DoAuth(a Auth) error {
+	_, challenge, err := a.Start(c)
+	if err != nil {
+		return err
+	}
+	for challenge != nil {
+		resp, err := c.Challenge(challenge)
+		if err != nil {
+			return err
+		}
+		if challenge, err = a.Next(resp, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Plain implements the PLAIN mechanism (RFC 4616).  Once DoAuth
+// returns successfully, Authzid, Username and Password hold the
+// fields decoded from the client's response.
+type Plain struct {
+	Authzid  string
+	Username string
+	Password string
+}
+
+// Start requests the client's PLAIN response; it never fails.
+func (a *Plain) Start(c *Conn) (string, []byte, error) {
+	return "PLAIN", []byte{}, nil
+}
+
+func (a *Plain) Next(fromClient []byte, more bool) ([]byte, error) {
+	parts := bytes.SplitN(fromClient, []byte{0}, 3)
+	if len(parts) != 3 {
+		return nil, errors.New("smtplike: malformed PLAIN response")
+	}
+	a.Authzid = string(parts[0])
+	a.Username = string(parts[1])
+	a.Password = string(parts[2])
+	return nil, nil
+}
+
+// Login implements the (non-standard but widely deployed) LOGIN
+// mechanism.  Once DoAuth returns successfully, Username and
+// Password hold the client's responses to the two challenges.
+type Login struct {
+	Username string
+	Password string
+	state    int
+}
+
+// Start requests the client's username; it never fails.
+func (a *Login) Start(c *Conn) (string, []byte, error) {
+	a.state = 0
+	return "LOGIN", []byte("Username:"), nil
+}
+
+func (a *Login) Next(fromClient []byte, more bool) ([]byte, error) {
+	switch a.state {
+	case 0:
+		a.Username = string(fromClient)
+		a.state = 1
+		return []byte("Password:"), nil
+	default:
+		a.Password = string(fromClient)
+		a.state = 2
+		return nil, nil
+	}
+}
+
+// CramMD5 implements the CRAM-MD5 mechanism (RFC 2195).  Start
+// generates a server nonce and sends it as the challenge; once
+// DoAuth returns successfully, Username holds the client's
+// claimed identity, and Verify checks the digest it sent against
+// a shared secret.
+type CramMD5 struct {
+	Username string
+	nonce    string
+	digest   string
+}
+
+// Start generates a fresh nonce and sends it as the challenge.
+func (a *CramMD5) Start(c *Conn) (string, []byte, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", nil, err
+	}
+	a.nonce = fmt.Sprintf("<%x.%d@smtplike>", b[:], time.Now().UnixNano())
+	return "CRAM-MD5", []byte(a.nonce), nil
+}
+
+func (a *CramMD5) Next(fromClient []byte, more bool) ([]byte, error) {
+	fields := bytes.Fields(fromClient)
+	if len(fields) != 2 {
+		return nil, errors.New("smtplike: malformed CRAM-MD5 response")
+	}
+	a.Username = string(fields[0])
+	a.digest = string(fields[1])
+	return nil, nil
+}
+
+// Verify reports whether the digest received from the client
+// matches hex(HMAC-MD5(secret, nonce)), the nonce being the one
+// sent as the challenge in Start.
+func (a *CramMD5) Verify(secret string) bool {
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(a.nonce))
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(a.digest))
+}
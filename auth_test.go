@@ -0,0 +1,238 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestChallengeMaxLineLength checks that Challenge bounds its
+// read the same way ReadMore does, rather than reading an
+// unbounded line straight off c.in.
+func TestChallengeMaxLineLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := Proto{Commands: []Command{
+		{"auth", func(args []string, c *Conn) (int, string) {
+			a := &Plain{}
+			if err := c.DoAuth(a); err != nil {
+				if err == ErrLineTooLong {
+					return 500, "line too long"
+				}
+				return 451, err.Error()
+			}
+			return 235, "ok"
+		}},
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- proto.RunWithOptions(server, nil, Options{MaxLineLength: 8})
+	}()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("auth\r\n"))
+	if got := readReply(t, r); !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("reply = %q, want 334 ...", got)
+	}
+	client.Write([]byte("this response is way longer than the line limit\r\n"))
+	if got := readReply(t, r); got != "500 line too long" {
+		t.Fatalf("reply = %q, want 500 line too long", got)
+	}
+	if err := <-done; err != ErrLineTooLong {
+		t.Fatalf("RunWithOptions returned %v, want ErrLineTooLong", err)
+	}
+}
+
+// TestDoAuthPlain drives a full PLAIN exchange through DoAuth and
+// checks the decoded fields it captures.
+func TestDoAuthPlain(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var got Plain
+	proto := Proto{Commands: []Command{
+		{"auth", func(args []string, c *Conn) (int, string) {
+			a := &Plain{}
+			if err := c.DoAuth(a); err != nil {
+				return 451, err.Error()
+			}
+			got = *a
+			return 235, "ok"
+		}},
+		{"quit", func(args []string, c *Conn) (int, string) { return Goodbye, "bye" }},
+	}}
+	done := make(chan error, 1)
+	go func() { done <- proto.RunWithOptions(server, nil, Options{}) }()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("auth\r\n"))
+	if got := readReply(t, r); !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("reply = %q, want 334 ...", got)
+	}
+	resp := base64.StdEncoding.EncodeToString([]byte("zid\x00user\x00pass"))
+	client.Write([]byte(resp + "\r\n"))
+	if reply := readReply(t, r); reply != "235 ok" {
+		t.Fatalf("reply = %q, want 235 ok", reply)
+	}
+	client.Write([]byte("quit\r\n"))
+	if reply := readReply(t, r); reply != "221 bye" {
+		t.Fatalf("reply = %q, want 221 bye", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+	if got.Authzid != "zid" || got.Username != "user" || got.Password != "pass" {
+		t.Fatalf("got %+v, want {zid user pass}", got)
+	}
+}
+
+// TestDoAuthLogin drives a full two-round LOGIN exchange through
+// DoAuth and checks the fields it captures.
+func TestDoAuthLogin(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var got Login
+	proto := Proto{Commands: []Command{
+		{"auth", func(args []string, c *Conn) (int, string) {
+			a := &Login{}
+			if err := c.DoAuth(a); err != nil {
+				return 451, err.Error()
+			}
+			got = *a
+			return 235, "ok"
+		}},
+		{"quit", func(args []string, c *Conn) (int, string) { return Goodbye, "bye" }},
+	}}
+	done := make(chan error, 1)
+	go func() { done <- proto.RunWithOptions(server, nil, Options{}) }()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("auth\r\n"))
+	if reply := readReply(t, r); reply != "334 "+base64.StdEncoding.EncodeToString([]byte("Username:")) {
+		t.Fatalf("reply = %q, want Username: prompt", reply)
+	}
+	client.Write([]byte(base64.StdEncoding.EncodeToString([]byte("user")) + "\r\n"))
+	if reply := readReply(t, r); reply != "334 "+base64.StdEncoding.EncodeToString([]byte("Password:")) {
+		t.Fatalf("reply = %q, want Password: prompt", reply)
+	}
+	client.Write([]byte(base64.StdEncoding.EncodeToString([]byte("pass")) + "\r\n"))
+	if reply := readReply(t, r); reply != "235 ok" {
+		t.Fatalf("reply = %q, want 235 ok", reply)
+	}
+	client.Write([]byte("quit\r\n"))
+	if reply := readReply(t, r); reply != "221 bye" {
+		t.Fatalf("reply = %q, want 221 bye", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+	if got.Username != "user" || got.Password != "pass" {
+		t.Fatalf("got %+v, want {user pass}", got)
+	}
+}
+
+// TestDoAuthCramMD5 drives a full CRAM-MD5 exchange through
+// DoAuth and checks that Verify accepts a digest computed over
+// the nonce it was actually challenged with.
+func TestDoAuthCramMD5(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	const secret = "sekrit"
+	var got CramMD5
+	proto := Proto{Commands: []Command{
+		{"auth", func(args []string, c *Conn) (int, string) {
+			a := &CramMD5{}
+			if err := c.DoAuth(a); err != nil {
+				return 451, err.Error()
+			}
+			got = *a
+			if !got.Verify(secret) {
+				return 535, "bad digest"
+			}
+			return 235, "ok"
+		}},
+		{"quit", func(args []string, c *Conn) (int, string) { return Goodbye, "bye" }},
+	}}
+	done := make(chan error, 1)
+	go func() { done <- proto.RunWithOptions(server, nil, Options{}) }()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("auth\r\n"))
+	reply := readReply(t, r)
+	if !strings.HasPrefix(reply, "334 ") {
+		t.Fatalf("reply = %q, want 334 ...", reply)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(reply, "334 "))
+	if err != nil {
+		t.Fatalf("decoding nonce: %v", err)
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(nonce)
+	digest := hex.EncodeToString(mac.Sum(nil))
+	resp := base64.StdEncoding.EncodeToString([]byte("user " + digest))
+	client.Write([]byte(resp + "\r\n"))
+	if reply := readReply(t, r); reply != "235 ok" {
+		t.Fatalf("reply = %q, want 235 ok", reply)
+	}
+	client.Write([]byte("quit\r\n"))
+	if reply := readReply(t, r); reply != "221 bye" {
+		t.Fatalf("reply = %q, want 221 bye", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+	if got.Username != "user" {
+		t.Fatalf("Username = %q, want user", got.Username)
+	}
+}
+
+// TestChallengeCancel checks that a lone "*" response cancels the
+// exchange with ErrAuthCancelled, as the AUTH command family
+// specifies.
+func TestChallengeCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := Proto{Commands: []Command{
+		{"auth", func(args []string, c *Conn) (int, string) {
+			a := &Plain{}
+			if err := c.DoAuth(a); err != nil {
+				if err == ErrAuthCancelled {
+					return 501, "cancelled"
+				}
+				return 451, err.Error()
+			}
+			return 235, "ok"
+		}},
+	}}
+	done := make(chan error, 1)
+	go func() { done <- proto.RunWithOptions(server, nil, Options{}) }()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("auth\r\n"))
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "334 ") {
+		t.Fatalf("reply = %q, want 334 ...", reply)
+	}
+	client.Write([]byte("*\r\n"))
+	if reply := readReply(t, r); reply != "501 cancelled" {
+		t.Fatalf("reply = %q, want 501 cancelled", reply)
+	}
+	if err := <-done; err != ErrAuthCancelled {
+		t.Fatalf("RunWithOptions returned %v, want ErrAuthCancelled", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrBareLineEnding is returned, when Options.StrictCRLF is set,
+// by ReadDotData and ReadDataReader upon finding a bare CR or LF,
+// one not part of a CRLF pair, in a dot-stuffed data block.
+var ErrBareLineEnding = errors.New("smtplike: bare CR or LF in data")
+
+// dotReader un-stuffs and streams a dot-stuffed, CRLF-terminated
+// data block as described in RFC 5321 §4.5.2, stopping at the
+// "." terminator line.  It implements io.Reader.
+type dotReader struct {
+	c     *Conn
+	buf   []byte
+	total int64
+	done  bool
+	err   error
+}
+
+func (d *dotReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 && !d.done && d.err == nil {
+		d.fill()
+	}
+	if len(d.buf) > 0 {
+		n := copy(p, d.buf)
+		d.buf = d.buf[n:]
+		return n, nil
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return 0, io.EOF
+}
+
+func (d *dotReader) fill() {
+	if d.err = d.c.setReadDeadline(d.c.readTimeout); d.err != nil {
+		d.c.err = d.err
+		return
+	}
+	line, err := readLine(d.c.in, d.c.maxLineLength)
+	if err != nil {
+		d.c.err, d.err = err, err
+		return
+	}
+	if d.c.strictCRLF && (!strings.HasSuffix(line, "\r\n") ||
+		strings.IndexByte(line[:len(line)-2], '\r') >= 0) {
+		d.c.err, d.err = ErrBareLineEnding, ErrBareLineEnding
+		return
+	}
+	if chop(line) == "." {
+		d.done = true
+		return
+	}
+	if strings.HasPrefix(line, ".") {
+		line = line[1:]
+	}
+	d.total += int64(len(line))
+	if d.c.maxMessageSize > 0 && d.total > d.c.maxMessageSize {
+		d.c.err, d.err = ErrMessageTooLarge, ErrMessageTooLarge
+		return
+	}
+	d.buf = append(d.buf, line...)
+}
+
+/*
+ReadDataReader requests a dot-stuffed data block from the client
+the way ReadMore does, but rather than buffering it all in
+memory, returns an io.Reader that un-stuffs and yields it as it's
+read, stopping at the "." terminator line.  It's meant for large
+bodies that should be streamed straight to their destination
+(disk, a pipe, ...) instead of held in a [][]string.
+
+Errors encountered while reading, including ErrMessageTooLarge
+and, if Options.StrictCRLF is set, ErrBareLineEnding, surface
+from the returned Reader's Read method and are also saved to c
+the way ReadMore saves them.
+*/
+func (c *Conn) ReadDataReader(code int, msg string) (io.Reader, error) {
+	if c.err = c.respondFlush(code, msg); c.err != nil {
+		return nil, c.err
+	}
+	return &dotReader{c: c}, nil
+}
+
+/*
+ReadDotData is ReadMore for a dot-stuffed data block: it sends
+code and msg, then reads lines until the "." terminator,
+un-stuffing any leading dot from each line per RFC 5321 §4.5.2
+and returning the rest of each line's raw bytes, line ending
+included, so that embedded whitespace and 8-bit data survive
+intact.  If Options.StrictCRLF is set, a bare CR or LF ends the
+read with ErrBareLineEnding.
+*/
+func (c *Conn) ReadDotData(code int, msg string) ([]string, error) {
+	r, err := c.ReadDataReader(code, msg)
+	if err != nil {
+		return nil, err
+	}
+	dr := r.(*dotReader)
+	var lines []string
+	var cur []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := dr.Read(buf)
+		for _, b := range buf[:n] {
+			cur = append(cur, b)
+			if b == '\n' {
+				lines = append(lines, string(cur))
+				cur = nil
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+	return lines, nil
+}
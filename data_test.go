@@ -0,0 +1,92 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestReadDotData checks that a dot-stuffed block is un-stuffed
+// and stops at the terminator line.
+func TestReadDotData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var got []string
+	proto := Proto{Commands: []Command{
+		{"data", func(args []string, c *Conn) (int, string) {
+			lines, err := c.ReadDotData(354, "go ahead")
+			if err != nil {
+				return 451, err.Error()
+			}
+			got = lines
+			return Goodbye, "ok"
+		}},
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- proto.RunWithOptions(server, nil, Options{})
+	}()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("data\r\n"))
+	if got := readReply(t, r); !strings.HasPrefix(got, "354 ") {
+		t.Fatalf("reply = %q, want 354 ...", got)
+	}
+	client.Write([]byte("..dot at the start\r\nplain line\r\n.\r\n"))
+	if reply := readReply(t, r); reply != "221 ok" {
+		t.Fatalf("reply = %q, want 221 ok", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+	want := []string{".dot at the start\r\n", "plain line\r\n"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("lines = %q, want %q", got, want)
+	}
+}
+
+// TestReadDotDataStrictCRLFOverride checks that a Handler which
+// gets ErrBareLineEnding back from ReadDotData and picks its own
+// reply actually gets that reply sent to the client before the
+// connection closes on the saved error, mirroring the
+// ErrMessageTooLarge override ReadMore offers.
+func TestReadDotDataStrictCRLFOverride(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := Proto{Commands: []Command{
+		{"data", func(args []string, c *Conn) (int, string) {
+			_, err := c.ReadDotData(354, "go ahead")
+			if err == ErrBareLineEnding {
+				return 550, "bare CR or LF in data"
+			}
+			return 250, "ok"
+		}},
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- proto.RunWithOptions(server, nil, Options{StrictCRLF: true})
+	}()
+
+	r := bufio.NewReader(client)
+	client.Write([]byte("data\r\n"))
+	if got := readReply(t, r); !strings.HasPrefix(got, "354 ") {
+		t.Fatalf("reply = %q, want 354 ...", got)
+	}
+	client.Write([]byte("bare line ending\n"))
+	if got := readReply(t, r); got != "550 bare CR or LF in data" {
+		t.Fatalf("reply = %q, want 550 bare CR or LF in data", got)
+	}
+	if err := <-done; err != ErrBareLineEnding {
+		t.Fatalf("RunWithOptions returned %v, want ErrBareLineEnding", err)
+	}
+}
@@ -18,11 +18,11 @@ import (
 	"net"
 )
 
-func greet(args []string, ctx interface{}) (code int, msg string) {
+func greet(args []string, c *smtplike.Conn) (code int, msg string) {
 	return smtplike.Hello, "may i help you?"
 }
 
-func help(args []string, ctx interface{}) (code int, msg string) {
+func help(args []string, c *smtplike.Conn) (code int, msg string) {
 	return 214, `commands:
 help
 helo
@@ -31,13 +31,13 @@ how is [someone]
 quit`
 }
 
-func hello(args []string, ctx interface{}) (code int, msg string) {
-	*ctx.(*bool) = true
+func hello(args []string, c *smtplike.Conn) (code int, msg string) {
+	*c.Ctx.(*bool) = true
 	return 250, "oh, hi!"
 }
 
-func how(args []string, ctx interface{}) (code int, msg string) {
-	if !*ctx.(*bool) {
+func how(args []string, c *smtplike.Conn) (code int, msg string) {
+	if !*c.Ctx.(*bool) {
 		return 503, "say helo first"
 	}
 	code, msg = 501, "usage:\n    how are you\n    how is [name]"
@@ -56,24 +56,26 @@ func how(args []string, ctx interface{}) (code int, msg string) {
 	return
 }
 
-func smtp(args []string, ctx interface{}) (code int, msg string) {
+func smtp(args []string, c *smtplike.Conn) (code int, msg string) {
 	return smtplike.Unavailable, "what is it, ESMTP?  service unavailable!"
 }
 
-func quit(args []string, ctx interface{}) (code int, msg string) {
+func quit(args []string, c *smtplike.Conn) (code int, msg string) {
 	return smtplike.Goodbye, "bye"
 }
 
 // the protocol
 var proto = smtplike.Proto{
-	{"", greet},
-	{"help", help},
-	{"helo", hello},
-	{"how", how},
-	{"quit", quit},
-	{"mail", smtp},
-	{"rcpt", smtp},
-	{"data", smtp},
+	Commands: []smtplike.Command{
+		{Command: "", Handler: greet},
+		{Command: "help", Handler: help},
+		{Command: "helo", Handler: hello},
+		{Command: "how", Handler: how},
+		{Command: "quit", Handler: quit},
+		{Command: "mail", Handler: smtp},
+		{Command: "rcpt", Handler: smtp},
+		{Command: "data", Handler: smtp},
+	},
 }
 
 func main() {
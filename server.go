@@ -0,0 +1,111 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+/*
+Server runs Proto over every connection accepted from Listener,
+applying Options (including any timeouts) to each, and keeps
+track of them so that Shutdown can ask them to wrap up.
+*/
+type Server struct {
+	Listener net.Listener
+	Proto    Proto
+	Options  Options
+
+	// NewCtx, if non-nil, is called once per accepted connection
+	// to produce the ctx passed to Proto's Handlers in Conn.
+	NewCtx func(net.Conn) interface{}
+
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	conns map[*Conn]struct{}
+	down  bool
+}
+
+/*
+Serve accepts connections from s.Listener, running s.Proto over
+each in its own goroutine, until the listener is closed.  It
+returns nil if that happened because of a call to Shutdown, or
+the error from Accept otherwise.
+*/
+func (s *Server) Serve() error {
+	for {
+		c, err := s.Listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			down := s.down
+			s.mu.Unlock()
+			if down {
+				return nil
+			}
+			return err
+		}
+		var ctx interface{}
+		if s.NewCtx != nil {
+			ctx = s.NewCtx(c)
+		}
+		pc := newConn(c, ctx, s.Options)
+		s.mu.Lock()
+		if s.conns == nil {
+			s.conns = make(map[*Conn]struct{})
+		}
+		s.conns[&pc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer c.Close()
+			s.Proto.run(&pc)
+			s.mu.Lock()
+			delete(s.conns, &pc)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+/*
+Shutdown closes s.Listener so Serve stops accepting, sends
+Unavailable (421) "server shutting down" to every connection
+currently being served and closes it, and waits for their
+Handlers to return.  It returns early with ctx's error if ctx is
+done first.
+
+Each Conn's own Handler goroutine may be calling (*Conn).respond
+concurrently with Shutdown; pc.writeMu, also taken by respond,
+keeps the two from writing to pc.out at the same time.
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.down = true
+	err := s.Listener.Close()
+	for pc := range s.conns {
+		pc.writeMu.Lock()
+		pc.respondLocked(Unavailable, "server shutting down", true)
+		pc.c.Close()
+		pc.writeMu.Unlock()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReadTimeout checks that a connection idle past ReadTimeout
+// gets Unavailable (421) and is closed.
+func TestReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	proto := Proto{Commands: []Command{
+		{"", func(args []string, c *Conn) (int, string) { return Hello, "hi" }},
+	}}
+	srv := &Server{
+		Listener: l,
+		Proto:    proto,
+		Options:  Options{ReadTimeout: 50 * time.Millisecond},
+	}
+	go srv.Serve()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if got := readReply(t, r); got != "220 hi" {
+		t.Fatalf("greeting = %q, want 220 hi", got)
+	}
+	if got := readReply(t, r); !strings.HasPrefix(got, "421 ") {
+		t.Fatalf("reply = %q, want 421 ...", got)
+	}
+}
+
+// TestShutdown checks that Shutdown closes every tracked Conn
+// without racing the Conn's own Handler goroutine, which may be
+// calling respond concurrently; run with -race to confirm.
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	chatter := make(chan struct{})
+	proto := Proto{Commands: []Command{
+		{"", func(args []string, c *Conn) (int, string) { return Hello, "hi" }},
+		{"noop", func(args []string, c *Conn) (int, string) { return 250, "ok" }},
+	}}
+	srv := &Server{Listener: l, Proto: proto}
+	go srv.Serve()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readReply(t, r) // greeting
+
+	// Keep the Handler's goroutine busy calling respond while
+	// Shutdown runs concurrently on the same Conn.
+	go func() {
+		defer close(chatter)
+		for i := 0; i < 100; i++ {
+			if _, err := conn.Write([]byte("noop\r\n")); err != nil {
+				return
+			}
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	<-chatter
+}
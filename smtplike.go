@@ -36,9 +36,13 @@ package smtplike
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -62,17 +66,121 @@ const (
 	Goodbye     = 221 // if a Handler returns this code, we're done
 	Unavailable = 421 // if a Handler returns this code, we're also done
 	UnknownCmd  = 500 // sent to client in case of an unknown command
+	LineTooLong = 500 // sent to client whose line exceeds MaxLineLength
 )
 
 var UnknownCmdMsg = "Unknown command" // the string to go along with UnknownCmd
 
+// DefaultMaxLineLength is the limit used in place of a zero
+// Options.MaxLineLength.  RFC 5321 bounds SMTP command lines at
+// 512 octets and text lines at 1000; this leaves headroom for
+// extensions without leaving the limit unbound.
+const DefaultMaxLineLength = 4096
+
+// ErrLineTooLong is returned by ReadMore and the Conn's other line
+// readers (Challenge, ReadDotData, ReadDataReader), and saved to
+// the Conn, when a line from the client exceeds MaxLineLength
+// before a newline is found; RunWithOptions then returns it once
+// the Handler's reply is sent.  A command line over the limit
+// instead gets LineTooLong (500), and RunWithOptions returns nil.
+var ErrLineTooLong = fmt.Errorf("smtplike: line too long")
+
+// ErrMessageTooLarge is returned by ReadMore, and saved to the
+// Conn, when the data read in a single multiline exchange
+// exceeds Options.MaxMessageSize.  Handlers that get it back
+// from ReadMore should reply with a 552-class code.
+var ErrMessageTooLarge = fmt.Errorf("smtplike: message too large")
+
+// isRecoverable reports whether err is a "soft" protocol-level
+// error saved to a Conn by ReadMore (or its relatives, including
+// ReadDotData/ReadDataReader's ErrBareLineEnding) or by
+// Conn.Challenge's ErrAuthCancelled, after which the connection
+// is still good enough for the Handler's own reply to reach the
+// client before runLoop closes it.
+func isRecoverable(err error) bool {
+	return err == ErrLineTooLong || err == ErrMessageTooLarge ||
+		err == ErrBareLineEnding || err == ErrAuthCancelled
+}
+
+/*
+Options configures the optional limits applied by
+(Proto).RunWithOptions.  The zero Options is the same as what
+(Proto).Run uses: DefaultMaxLineLength and no message size limit.
+*/
+type Options struct {
+	// MaxLineLength caps the length of a single line read from
+	// the client, terminator included.  Zero means
+	// DefaultMaxLineLength.
+	MaxLineLength int
+	// MaxMessageSize caps the total number of bytes ReadMore
+	// will accumulate in one multiline exchange.  Zero means no
+	// limit.
+	MaxMessageSize int64
+
+	// ReadTimeout and WriteTimeout bound each read from, and
+	// write to, the client; zero means no deadline.
+	ReadTimeout, WriteTimeout time.Duration
+	// IdleTimeout bounds the wait for the next command after a
+	// response has been sent; zero means ReadTimeout applies
+	// there too.
+	IdleTimeout time.Duration
+
+	// StrictCRLF makes ReadDotData and ReadDataReader treat a
+	// bare CR or LF (one without its other half) in a
+	// dot-stuffed data block as a protocol error instead of
+	// passing it through.
+	StrictCRLF bool
+
+	// Logger, if non-nil, receives one line per connection
+	// open/close, per command received and per response sent.
+	Logger Logger
+	// RedactCommands lists, in lowercase, commands whose
+	// arguments should be omitted from the log, e.g. "auth".
+	RedactCommands []string
+}
+
+// Logger is the logging interface Options.Logger must
+// implement; *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// readLine reads a line terminated by '\n', like
+// bufio.Reader.ReadString, but gives up with ErrLineTooLong
+// once more than max bytes have been read without finding one.
+func readLine(in *bufio.Reader, max int) (string, error) {
+	var buf []byte
+	for {
+		frag, err := in.ReadSlice('\n')
+		if len(buf)+len(frag) > max {
+			return "", ErrLineTooLong
+		}
+		buf = append(buf, frag...)
+		if err == nil {
+			return string(buf), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return string(buf), err
+		}
+	}
+}
+
+// Command pairs a command string with its Handler, the element
+// type of Proto.Commands.
+type Command struct {
+	Command string
+	Handler func(args []string, c *Conn) (code int, msg string)
+}
+
 /*
-Proto defines the mapping between commands and hadlers.
+Proto defines the mapping between commands and Handlers, and
+optionally the capabilities to advertise in an EHLO-style reply
+(see BuildEHLOReply).
 
 Command strings should be lowercase.  The Command of the 0th
-element may be an empty string, in which case its Handler is
-called immediately after receiving a connection to greet the
-client.
+element of Commands may be an empty string, in which case its
+Handler is called immediately after receiving a connection to
+greet the client.
 
 The Handler functions receive the arguments sent with the
 Command and a context, and return the numeric code and message to
@@ -83,9 +191,24 @@ Unavailable (421) as the code, the connection is terminated.
 The handling of the protocol is described in more detail under
 Run().
 */
-type Proto []struct {
-	Command string
-	Handler func(args []string, c *Conn) (code int, msg string)
+type Proto struct {
+	Commands []Command
+	// Capabilities, if non-nil, is available for Handlers to
+	// build an EHLO-style reply from with BuildEHLOReply; Proto
+	// itself does nothing with it.
+	Capabilities []string
+}
+
+/*
+BuildEHLOReply formats greeting and caps as the lines of a
+multi-line reply of the kind EHLO-style commands send: greeting
+first, then each of caps as a continuation line.  The result is
+meant to be returned as a Handler's msg, dash/space continuation
+separators being (Conn).respond's job as with any other
+multiline reply.
+*/
+func BuildEHLOReply(greeting string, caps []string) string {
+	return strings.Join(append([]string{greeting}, caps...), "\n")
 }
 
 // Conn represents a connection.
@@ -94,20 +217,117 @@ type Conn struct {
 	Ctx interface{} // ctx as passed to (Proto).Run().
 	c   net.Conn
 	in  *bufio.Reader
+	out *bufio.Writer
 	err error
+	tls *tls.Conn // set by StartTLS once the handshake succeeds
+
+	maxLineLength  int   // from Options.MaxLineLength, defaulted
+	maxMessageSize int64 // from Options.MaxMessageSize
+
+	readTimeout, writeTimeout, idleTimeout time.Duration // from Options
+	strictCRLF                             bool          // from Options.StrictCRLF
+
+	logger Logger          // from Options.Logger
+	redact map[string]bool // from Options.RedactCommands
+	reqID  uint64
+
+	// writeMu serializes respond() against Server.Shutdown, which
+	// sends its own final reply to every Conn it's tracking from
+	// a goroutine separate from the one running that Conn's
+	// Handlers.
+	writeMu sync.Mutex
+}
+
+// RemoteAddr returns the client's network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.c.RemoteAddr()
+}
+
+// RequestID returns an ID unique among the connections a process
+// has served, suitable for correlating a Handler's own logging
+// with the lines Options.Logger receives for c.
+func (c *Conn) RequestID() uint64 {
+	return c.reqID
 }
 
+func (c *Conn) logf(format string, args ...interface{}) {
+	if c.logger == nil {
+		return
+	}
+	c.logger.Printf(format, args...)
+}
+
+// logCommand logs cmd and args, replacing args with "..." when
+// cmd is in c.redact.
+func (c *Conn) logCommand(cmd string, args []string) {
+	if c.logger == nil {
+		return
+	}
+	if c.redact[cmd] {
+		c.logf("id=%d cmd=%s args=...", c.reqID, cmd)
+		return
+	}
+	c.logf("id=%d cmd=%s args=%v", c.reqID, cmd, args)
+}
+
+func (c *Conn) setReadDeadline(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	return c.c.SetReadDeadline(time.Now().Add(d))
+}
+
+func (c *Conn) setWriteDeadline(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	return c.c.SetWriteDeadline(time.Now().Add(d))
+}
+
+// respond writes code and msg through c.out, a bufio.Writer.  It
+// flushes c.out immediately unless c.in still has a pipelined
+// command buffered (RFC 2920): in that case the write is left
+// batched with whatever reply follows, so a PIPELINED run of
+// commands costs one underlying write instead of one per
+// response.  A response with code Goodbye or Unavailable always
+// flushes, since those end the connection.
 func (c *Conn) respond(code int, msg string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.respondLocked(code, msg, false)
+}
+
+// respondFlush is respond but always flushes c.out before
+// returning, for callers such as ReadMore and StartTLS whose own
+// reply must reach the client before anything else happens.
+func (c *Conn) respondFlush(code int, msg string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.respondLocked(code, msg, true)
+}
+
+// respondLocked is respond/respondFlush without acquiring
+// writeMu, for callers (Server.Shutdown) that need to hold it
+// across a respond followed by closing c.c.
+func (c *Conn) respondLocked(code int, msg string, force bool) error {
 	lines := strings.Split(msg, "\n")
 	if len(lines) == 0 {
 		lines = []string{""}
 	}
-	s := ""
+	if err := c.setWriteDeadline(c.writeTimeout); err != nil {
+		return err
+	}
 	for _, v := range lines[:len(lines)-1] {
-		s += fmt.Sprintf("%03d-%s\r\n", code, v)
+		fmt.Fprintf(c.out, "%03d-%s\r\n", code, v)
+	}
+	fmt.Fprintf(c.out, "%03d %s\r\n", code, lines[len(lines)-1])
+	var err error
+	if force || code == Goodbye || code == Unavailable || c.in.Buffered() == 0 {
+		err = c.out.Flush()
+	}
+	if err == nil {
+		c.logf("id=%d response %d", c.reqID, code)
 	}
-	s += fmt.Sprintf("%03d %s\r\n", code, lines[len(lines)-1])
-	_, err := c.c.Write([]byte(s))
 	return err
 }
 
@@ -132,6 +352,10 @@ line, are returned as a string array.
 If ReadMore encounters an error, it's returned to the caller and
 saved.  When the Handler returns, the connection will be closed
 and (Proto).Run() will return the same saved error to its caller.
+Besides I/O errors, ErrLineTooLong and ErrMessageTooLarge (see
+Options) can be returned this way; a Handler that wants to reply
+552 to the client on ErrMessageTooLarge rather than just
+dropping the connection should check for it explicitly.
 
 Example:
 
@@ -144,15 +368,19 @@ Example:
 		// save lines
 		return 250, "Ok"
 	}
-
 */
 func (c *Conn) ReadMore(code int, msg string, end string) ([]string, error) {
-	if c.err = c.respond(code, msg); c.err != nil {
+	if c.err = c.respondFlush(code, msg); c.err != nil {
 		return nil, c.err
 	}
 	var lines []string
+	var total int64
 	for {
-		line, err := c.in.ReadString('\n')
+		if err := c.setReadDeadline(c.readTimeout); err != nil {
+			c.err = err
+			return lines, err
+		}
+		line, err := readLine(c.in, c.maxLineLength)
 		if err != nil {
 			c.err = err
 			return lines, err
@@ -160,11 +388,59 @@ func (c *Conn) ReadMore(code int, msg string, end string) ([]string, error) {
 		if chop(line) == end {
 			break
 		}
+		total += int64(len(line))
+		if c.maxMessageSize > 0 && total > c.maxMessageSize {
+			c.err = ErrMessageTooLarge
+			return lines, ErrMessageTooLarge
+		}
 		lines = append(lines, line)
 	}
 	return lines, nil
 }
 
+/*
+StartTLS upgrades the connection to TLS.
+
+It sends code and msg as an intermediate response, then wraps
+the underlying connection in a server-side tls.Conn using config
+and performs the handshake.  On success, all following reads and
+writes, including those done by the Handler that called
+StartTLS, take place over the encrypted connection.
+
+StartTLS is meant to be called from the Handler for a
+STARTTLS-style command, typically with code 220, before any
+other multiline exchange such as ReadMore has started.
+*/
+func (c *Conn) StartTLS(code int, msg string, config *tls.Config) error {
+	if c.err = c.respondFlush(code, msg); c.err != nil {
+		return c.err
+	}
+	tc := tls.Server(c.c, config)
+	if c.err = tc.Handshake(); c.err != nil {
+		return c.err
+	}
+	// Shutdown reads/writes c.c and c.out under c.writeMu from a
+	// different goroutine; take the same lock here so it can't
+	// observe these fields mid-reassignment.
+	c.writeMu.Lock()
+	c.c = tc
+	c.in = bufio.NewReader(tc)
+	c.out = bufio.NewWriter(tc)
+	c.tls = tc
+	c.writeMu.Unlock()
+	return nil
+}
+
+// TLSState returns the ConnectionState of the underlying TLS
+// connection and true, or a zero ConnectionState and false if
+// StartTLS has not yet succeeded on c.
+func (c *Conn) TLSState() (tls.ConnectionState, bool) {
+	if c.tls == nil {
+		return tls.ConnectionState{}, false
+	}
+	return c.tls.ConnectionState(), true
+}
+
 /*
 Run runs the server for the protocol described by p on the
 connection c, passing application-dependent connection-specific
@@ -172,15 +448,30 @@ context ctx to Handler fuctions in Conn.  It returns an error if
 reading from or writing to c fails, or nil if the connection is
 terminated successfully.
 
-If p[0].Command is an empty string, Run calls p[0].Handler upon
-entry to greet the client, with an empty array in args.  Its
-return values are handled like those of any other Handler.  The
-constant Hello (220) would be a good code to return.
+Run is RunWithOptions with the zero Options, i.e. with
+DefaultMaxLineLength and no message size limit.
+*/
+func (p Proto) Run(c net.Conn, ctx interface{}) error {
+	return p.RunWithOptions(c, ctx, Options{})
+}
+
+/*
+RunWithOptions is Run with the limits in opts applied: lines from
+the client longer than opts.MaxLineLength (DefaultMaxLineLength
+if zero) get LineTooLong (500) and the connection is closed, and
+ReadMore refuses to accumulate more than opts.MaxMessageSize
+bytes of data (no limit if zero).
+
+If p.Commands[0].Command is an empty string, Run calls its
+Handler upon entry to greet the client, with an empty array in
+args.  Its return values are handled like those of any other
+Handler.  The constant Hello (220) would be a good code to
+return.
 
 Each time a line is received from the network connection,
 it's broken by string.Fields() into command and arguments.  The
-command is then converted to lower case and matched against the
-Commands in the Proto array.
+command is then converted to lower case and matched against
+p.Commands.
 
 If a matching Command is found, its Handler is called with
 the command's arguments in args and the context for the
@@ -197,15 +488,61 @@ prepended by the code and followed by '\r\n', in the normal
 SMTP-like fashion.  If the code is equal to Goodbye (221) or
 Unavailable (421), the connection is then terminated.
 */
-func (p Proto) Run(c net.Conn, ctx interface{}) error {
+func (p Proto) RunWithOptions(c net.Conn, ctx interface{}, opts Options) error {
 	defer c.Close()
-	pc := Conn{
-		Ctx: ctx,
-		c:   c,
-		in:  bufio.NewReader(c),
+	pc := newConn(c, ctx, opts)
+	return p.run(&pc)
+}
+
+// lastReqID hands out the IDs returned by (*Conn).RequestID.
+var lastReqID uint64
+
+// newConn builds the Conn that Run/RunWithOptions and
+// (*Server).Serve run p's Handlers against, applying opts'
+// defaults.
+func newConn(c net.Conn, ctx interface{}, opts Options) Conn {
+	maxLine := opts.MaxLineLength
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineLength
+	}
+	var redact map[string]bool
+	if len(opts.RedactCommands) != 0 {
+		redact = make(map[string]bool, len(opts.RedactCommands))
+		for _, cmd := range opts.RedactCommands {
+			redact[cmd] = true
+		}
+	}
+	return Conn{
+		Ctx:            ctx,
+		c:              c,
+		in:             bufio.NewReader(c),
+		out:            bufio.NewWriter(c),
+		maxLineLength:  maxLine,
+		maxMessageSize: opts.MaxMessageSize,
+		readTimeout:    opts.ReadTimeout,
+		writeTimeout:   opts.WriteTimeout,
+		idleTimeout:    opts.IdleTimeout,
+		strictCRLF:     opts.StrictCRLF,
+		logger:         opts.Logger,
+		redact:         redact,
+		reqID:          atomic.AddUint64(&lastReqID, 1),
 	}
-	if len(p) != 0 && p[0].Command == "" {
-		code, msg := p[0].Handler([]string{}, &pc)
+}
+
+// run is the command loop shared by RunWithOptions and
+// (*Server).Serve; pc must already be initialized by newConn.
+func (p Proto) run(pc *Conn) error {
+	pc.logf("id=%d connection open remote=%s", pc.reqID, pc.RemoteAddr())
+	err := p.runLoop(pc)
+	pc.logf("id=%d connection closed remote=%s err=%v", pc.reqID, pc.RemoteAddr(), err)
+	return err
+}
+
+// runLoop is (Proto).run without the open/close logging, broken
+// out so every return path gets logged exactly once.
+func (p Proto) runLoop(pc *Conn) error {
+	if len(p.Commands) != 0 && p.Commands[0].Command == "" {
+		code, msg := p.Commands[0].Handler([]string{}, pc)
 		if err := pc.respond(code, msg); err != nil {
 			return err
 		}
@@ -213,8 +550,23 @@ func (p Proto) Run(c net.Conn, ctx interface{}) error {
 			return nil
 		}
 	}
+	idleTimeout := pc.idleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = pc.readTimeout
+	}
 	for {
-		line, err := pc.in.ReadString('\n')
+		if err := pc.setReadDeadline(idleTimeout); err != nil {
+			return err
+		}
+		line, err := readLine(pc.in, pc.maxLineLength)
+		if err == ErrLineTooLong {
+			pc.respondFlush(LineTooLong, "Line too long")
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			pc.respond(Unavailable, "timeout")
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -222,11 +574,24 @@ func (p Proto) Run(c net.Conn, ctx interface{}) error {
 		code, msg := UnknownCmd, UnknownCmdMsg
 		if len(f) != 0 {
 			cmd := strings.ToLower(f[0])
-			for _, v := range p {
+			pc.logCommand(cmd, f[1:])
+			for _, v := range p.Commands {
 				if v.Command == cmd {
-					code, msg = v.Handler(f[1:], &pc)
+					code, msg = v.Handler(f[1:], pc)
 					if pc.err != nil {
-						return pc.err
+						if !isRecoverable(pc.err) {
+							return pc.err
+						}
+						// The Handler got a chance to see a
+						// soft error from ReadMore and pick its
+						// own code/msg (552, say); send that
+						// before closing on the saved error.
+						saved := pc.err
+						pc.err = nil
+						if werr := pc.respondFlush(code, msg); werr != nil {
+							return werr
+						}
+						return saved
 					}
 					break
 				}
@@ -0,0 +1,159 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readReply reads one (possibly multiline) reply off r and returns
+// its last line, chomped.
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var last string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		last = chop(line)
+		if len(last) >= 4 && last[3] == ' ' {
+			return last
+		}
+	}
+}
+
+// TestMaxLineLength checks that a line longer than MaxLineLength
+// gets LineTooLong (500) and closes the connection, per
+// RunWithOptions' doc comment.
+func TestMaxLineLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := Proto{Commands: []Command{
+		{"", func(args []string, c *Conn) (int, string) { return Hello, "hi" }},
+		{"noop", func(args []string, c *Conn) (int, string) { return 250, "ok" }},
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- proto.RunWithOptions(server, nil, Options{MaxLineLength: 8})
+	}()
+
+	r := bufio.NewReader(client)
+	if got := readReply(t, r); got != "220 hi" {
+		t.Fatalf("greeting = %q, want 220 hi", got)
+	}
+	if _, err := client.Write([]byte("noop this line is way too long\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readReply(t, r); !strings.HasPrefix(got, "500 ") {
+		t.Fatalf("reply = %q, want 500 ...", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+}
+
+// TestReadMoreOverride checks that a Handler which gets
+// ErrMessageTooLarge back from ReadMore and picks its own reply
+// actually gets that reply sent to the client before the
+// connection is closed with the saved error, per ReadMore's doc
+// comment.
+func TestReadMoreOverride(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := Proto{Commands: []Command{
+		{"data", func(args []string, c *Conn) (int, string) {
+			_, err := c.ReadMore(354, "go ahead", ".")
+			if err == ErrMessageTooLarge {
+				return 552, "too much mail data"
+			}
+			return 250, "ok"
+		}},
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- proto.RunWithOptions(server, nil, Options{MaxMessageSize: 10})
+	}()
+
+	r := bufio.NewReader(client)
+	if _, err := client.Write([]byte("data\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readReply(t, r); !strings.HasPrefix(got, "354 ") {
+		t.Fatalf("reply = %q, want 354 ...", got)
+	}
+	if _, err := client.Write([]byte("this line alone is over the ten byte limit\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readReply(t, r); got != "552 too much mail data" {
+		t.Fatalf("reply = %q, want 552 too much mail data", got)
+	}
+	if err := <-done; err != ErrMessageTooLarge {
+		t.Fatalf("RunWithOptions returned %v, want ErrMessageTooLarge", err)
+	}
+}
+
+// countedWriteConn counts the Write calls that reach the
+// underlying net.Conn, for TestPipelinedRepliesBatchWrite.
+type countedWriteConn struct {
+	net.Conn
+	writes *int
+}
+
+func (c countedWriteConn) Write(p []byte) (int, error) {
+	*c.writes++
+	return c.Conn.Write(p)
+}
+
+// TestPipelinedRepliesBatchWrite checks that replies to a batch
+// of pipelined commands are held back and sent as a single
+// underlying write, per respond's doc comment, rather than one
+// write per response.
+func TestPipelinedRepliesBatchWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var writes int
+	proto := Proto{Commands: []Command{
+		{"noop", func(args []string, c *Conn) (int, string) { return 250, "ok" }},
+		{"quit", func(args []string, c *Conn) (int, string) { return Goodbye, "bye" }},
+	}}
+	done := make(chan error, 1)
+	go func() {
+		done <- proto.RunWithOptions(countedWriteConn{server, &writes}, nil, Options{})
+	}()
+
+	r := bufio.NewReader(client)
+	if _, err := client.Write([]byte("noop\r\nnoop\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readReply(t, r); got != "250 ok" {
+		t.Fatalf("reply = %q, want 250 ok", got)
+	}
+	if got := readReply(t, r); got != "250 ok" {
+		t.Fatalf("reply = %q, want 250 ok", got)
+	}
+	if writes != 1 {
+		t.Fatalf("writes to conn = %d, want 1 for two pipelined replies", writes)
+	}
+	client.Write([]byte("quit\r\n"))
+	if got := readReply(t, r); got != "221 bye" {
+		t.Fatalf("reply = %q, want 221 bye", got)
+	}
+	if writes != 2 {
+		t.Fatalf("writes to conn = %d, want 2 after quit's own write", writes)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+}
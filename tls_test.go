@@ -0,0 +1,154 @@
+// Copyright 2012 Vadim Vygonets
+// This program is free software. It comes without any warranty, to
+// the extent permitted by applicable law. You can redistribute it
+// and/or modify it under the terms of the Do What The Fuck You Want
+// To Public License, Version 2, as published by Sam Hocevar. See
+// the LICENSE file or http://sam.zoy.org/wtfpl/ for more details.
+
+package smtplike
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSConfig generates a throwaway self-signed cert/key pair
+// and returns a server tls.Config using it.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func starttlsProto(cfg *tls.Config) Proto {
+	return Proto{Commands: []Command{
+		{"", func(args []string, c *Conn) (int, string) { return Hello, "hi" }},
+		{"starttls", func(args []string, c *Conn) (int, string) {
+			if err := c.StartTLS(220, "go ahead", cfg); err != nil {
+				return 454, "TLS not available"
+			}
+			return 250, "go secure"
+		}},
+		{"noop", func(args []string, c *Conn) (int, string) { return 250, "ok" }},
+		{"quit", func(args []string, c *Conn) (int, string) { return Goodbye, "bye" }},
+	}}
+}
+
+// TestStartTLSHandshake checks the happy path: a client that
+// issues STARTTLS, performs the handshake and then exchanges a
+// command over the now-encrypted connection.
+func TestStartTLSHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := starttlsProto(testTLSConfig(t))
+	done := make(chan error, 1)
+	go func() { done <- proto.RunWithOptions(server, nil, Options{}) }()
+
+	plain := bufio.NewReader(client)
+	if got := readReply(t, plain); got != "220 hi" {
+		t.Fatalf("greeting = %q, want 220 hi", got)
+	}
+	client.Write([]byte("starttls\r\n"))
+	if got := readReply(t, plain); !strings.HasPrefix(got, "220 ") {
+		t.Fatalf("reply = %q, want 220 ...", got)
+	}
+
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	secure := bufio.NewReader(tc)
+	if got := readReply(t, secure); got != "250 go secure" {
+		t.Fatalf("reply = %q, want 250 go secure", got)
+	}
+
+	tc.Write([]byte("noop\r\n"))
+	if got := readReply(t, secure); got != "250 ok" {
+		t.Fatalf("reply = %q, want 250 ok", got)
+	}
+	tc.Write([]byte("quit\r\n"))
+	if got := readReply(t, secure); got != "221 bye" {
+		t.Fatalf("reply = %q, want 221 bye", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+}
+
+// TestStartTLSDiscardsBufferedPlaintext checks that plaintext
+// pipelined past the STARTTLS command line, which may already sit
+// buffered in the pre-upgrade bufio.Reader, is discarded along
+// with that Reader rather than replayed as if it had arrived over
+// the encrypted connection: a command smuggled in like this must
+// not be acted on until the client actually sends it under TLS.
+func TestStartTLSDiscardsBufferedPlaintext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	proto := starttlsProto(testTLSConfig(t))
+	done := make(chan error, 1)
+	go func() { done <- proto.RunWithOptions(server, nil, Options{}) }()
+
+	plain := bufio.NewReader(client)
+	if got := readReply(t, plain); got != "220 hi" {
+		t.Fatalf("greeting = %q, want 220 hi", got)
+	}
+	// "quit" rides along in the same write as "starttls": if it
+	// were read back after the upgrade instead of discarded, the
+	// connection would close here with 221 instead of reaching
+	// the post-handshake "noop" exchange below.
+	client.Write([]byte("starttls\r\nquit\r\n"))
+	if got := readReply(t, plain); !strings.HasPrefix(got, "220 ") {
+		t.Fatalf("reply = %q, want 220 ...", got)
+	}
+
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	secure := bufio.NewReader(tc)
+	if got := readReply(t, secure); got != "250 go secure" {
+		t.Fatalf("reply = %q, want 250 go secure", got)
+	}
+
+	tc.Write([]byte("noop\r\n"))
+	if got := readReply(t, secure); got != "250 ok" {
+		t.Fatalf("reply = %q, want 250 ok (buffered plaintext quit must not have run)", got)
+	}
+	tc.Write([]byte("quit\r\n"))
+	if got := readReply(t, secure); got != "221 bye" {
+		t.Fatalf("reply = %q, want 221 bye", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunWithOptions returned %v, want nil", err)
+	}
+}